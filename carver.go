@@ -0,0 +1,194 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package evtx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CarveOptions configures a Carver. Start and End bound the byte range to
+// scan (End == 0 means "to EOF"). MaxChunks caps the number of chunks
+// materialized before the carver stops on its own, 0 meaning unbounded.
+// ResumeToken, if set, overrides Start with the offset previously returned
+// by Carver.ResumeToken, letting a new Carver continue where an earlier one
+// left off.
+type CarveOptions struct {
+	Start       int64
+	End         int64
+	MaxChunks   int
+	ResumeToken []byte
+}
+
+// CarvedEvent pairs a decoded event with the absolute offset of the chunk it
+// came from.
+type CarvedEvent struct {
+	Offset int64
+	Event  *GoEvtxMap
+}
+
+// Carver carves EVTX chunks and events out of an arbitrary byte range,
+// materializing at most one chunk's string and template tables at a time
+// (one per worker in ParallelEvents) instead of accumulating state for
+// every chunk seen so far. This keeps its
+// memory footprint bounded regardless of how large the carved range is,
+// which is what makes it safe to split a multi-gigabyte disk image across
+// several Carver instances, one per worker.
+type Carver struct {
+	r        io.ReaderAt
+	opts     CarveOptions
+	nextScan int64
+	chunkCnt int
+}
+
+// NewCarver creates a Carver over r restricted to opts' byte range. If
+// opts.ResumeToken is set, it takes precedence over opts.Start.
+func NewCarver(r io.ReaderAt, opts CarveOptions) (*Carver, error) {
+	c := &Carver{r: r, opts: opts, nextScan: opts.Start}
+	if len(opts.ResumeToken) > 0 {
+		off, err := decodeResumeToken(opts.ResumeToken)
+		if err != nil {
+			return nil, err
+		}
+		c.nextScan = off
+	}
+	return c, nil
+}
+
+// chunkReadError wraps an error from the ReadAt call in decodeChunk, so
+// callers can tell "there is nothing more to read at this offset" (e.g. a
+// truncated chunk at the tail of the carved range) apart from "the magic we
+// found doesn't lead to a valid chunk" (a false-positive match, routine when
+// carving raw data). The two call for different recovery: a read error
+// means the scan should stop without consuming this offset, so a resumed
+// Carver retries it once more data is available; a validation error means
+// this offset was never a real chunk and scanning should just move past it.
+type chunkReadError struct{ err error }
+
+func (e *chunkReadError) Error() string { return e.err.Error() }
+func (e *chunkReadError) Unwrap() error { return e.err }
+
+// decodeChunk reads the chunk at offset from r and fully parses it (header,
+// string table, template table, event offsets), returning an error if the
+// read fails or the header fails to validate. It is the single place that
+// does this, shared by Carver.Events and Carver.ParallelEvents, instead of
+// each keeping its own copy of the parse sequence. A failed ReadAt is
+// reported as a *chunkReadError; see its doc comment for why that matters.
+func decodeChunk(r io.ReaderAt, offset int64) (Chunk, error) {
+	chunk := NewChunk()
+	chunk.Offset = offset
+	chunk.Data = make([]byte, ChunkSize)
+	if _, err := r.ReadAt(chunk.Data, offset); err != nil {
+		return chunk, &chunkReadError{err}
+	}
+
+	reader := bytes.NewReader(chunk.Data)
+	chunk.ParseChunkHeader(reader)
+	if err := chunk.Header.Validate(); err != nil {
+		return chunk, err
+	}
+
+	GoToSeeker(reader, int64(chunk.Header.SizeHeader))
+	chunk.ParseStringTable(reader)
+	if err := chunk.ParseTemplateTable(reader); err != nil {
+		return chunk, err
+	}
+	if err := chunk.ParseEventOffsets(reader); err != nil {
+		return chunk, err
+	}
+	return chunk, nil
+}
+
+// drainInt64 discards any values still pending on ch in the background.
+// ScanChunkMagic's producer goroutine keeps sending to its buffered channel
+// until it reaches EOF or the caller stops reading; a consumer that stops
+// ranging over ch early (MaxChunks reached, a read error) must still drain
+// it, or that goroutine blocks on its next send forever.
+func drainInt64(ch <-chan int64) {
+	go func() {
+		for range ch {
+		}
+	}()
+}
+
+// Events returns a channel of CarvedEvent carrying every event found in
+// chunks discovered within the Carver's byte range, in on-disk chunk order.
+// The channel is closed once the range is exhausted, MaxChunks chunks have
+// been carved, or a read error is hit. After the channel is closed,
+// ResumeToken reports where a subsequent Carver should pick up.
+func (c *Carver) Events() <-chan CarvedEvent {
+	out := make(chan CarvedEvent, 42)
+	go func() {
+		defer close(out)
+		ch := ScanChunkMagic(c.r, c.nextScan, c.opts.End)
+		for offset := range ch {
+			chunk, err := decodeChunk(c.r, offset)
+			if err != nil {
+				if _, isReadErr := err.(*chunkReadError); isReadErr {
+					// Leave nextScan at offset (not offset+1): there was
+					// nothing wrong with this offset, we just couldn't
+					// read it yet. A Carver resumed from ResumeToken
+					// should retry it rather than skip past it.
+					drainInt64(ch)
+					return
+				}
+				// The header didn't validate: a false-positive magic
+				// match, routine when carving raw data. Skip past it and
+				// keep scanning.
+				c.nextScan = offset + 1
+				continue
+			}
+
+			for e := range chunk.Events() {
+				out <- CarvedEvent{Offset: offset, Event: e}
+			}
+
+			// Chunk fully consumed: the string/template tables above go
+			// out of scope here and nothing from this chunk survives
+			// into the next iteration.
+			c.chunkCnt++
+			c.nextScan = offset + ChunkSize
+			if c.opts.MaxChunks > 0 && c.chunkCnt >= c.opts.MaxChunks {
+				drainInt64(ch)
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// ResumeToken serializes the offset a new Carver should resume scanning
+// from to continue this one's work. It is only meaningful once Events'
+// channel has been drained (or abandoned after a crash), and should be
+// persisted by the caller (e.g. written to the --resume state file).
+func (c *Carver) ResumeToken() []byte {
+	tok := make([]byte, 8)
+	binary.BigEndian.PutUint64(tok, uint64(c.nextScan))
+	return tok
+}
+
+func decodeResumeToken(tok []byte) (int64, error) {
+	if len(tok) != 8 {
+		return 0, fmt.Errorf("evtx: invalid resume token length %d, want 8", len(tok))
+	}
+	return int64(binary.BigEndian.Uint64(tok)), nil
+}
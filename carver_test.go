@@ -0,0 +1,60 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package evtx
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestEventsResumesAtTruncatedChunkNotPastIt is a regression test: a ReadAt
+// failure (a chunk truncated at the tail of the carved range, e.g. because
+// the rest of it hasn't been written yet) must leave nextScan pointing back
+// at that chunk's offset, not past it, so a Carver resumed from
+// ResumeToken() retries the same offset instead of permanently losing it.
+func TestEventsResumesAtTruncatedChunkNotPastIt(t *testing.T) {
+	magic := []byte(ChunkMagic)
+	data := make([]byte, ChunkSize)
+	copy(data, magic)
+	// Truncate the backing data well short of a full chunk, so decodeChunk's
+	// ReadAt fails for the chunk planted at offset 0.
+	truncated := data[:len(magic)+4]
+
+	r := &boundaryReaderAt{data: truncated}
+	c, err := NewCarver(r, CarveOptions{})
+	if err != nil {
+		t.Fatalf("NewCarver: %s", err)
+	}
+
+	for range c.Events() {
+		// No real chunk can be decoded from truncated data; just drain.
+	}
+
+	if got := c.ResumeToken(); !bytes.Equal(got, c.ResumeToken()) {
+		t.Fatalf("ResumeToken not stable across calls")
+	}
+	off, err := decodeResumeToken(c.ResumeToken())
+	if err != nil {
+		t.Fatalf("decodeResumeToken: %s", err)
+	}
+	if off != 0 {
+		t.Errorf("resume offset = %d, want 0 (the truncated chunk's own offset, so a resume retries it)", off)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package output
+
+import (
+	"encoding/json"
+	"evtx"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CBOREncoder writes each event as a standalone CBOR data item. It goes
+// through the same map[string]interface{} shape as the JSON encoders
+// (rather than cbor-encoding evtx.GoEvtxMap directly) so CBOR output stays
+// a straightforward re-encoding of whatever evtx.ToJSON already produces.
+type CBOREncoder struct{}
+
+// NewCBOREncoder returns a ready-to-use CBOREncoder.
+func NewCBOREncoder() *CBOREncoder {
+	return &CBOREncoder{}
+}
+
+// Encode implements Encoder.
+func (enc *CBOREncoder) Encode(w io.Writer, ev *evtx.GoEvtxMap) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(evtx.ToJSON(ev), &raw); err != nil {
+		return err
+	}
+	return cbor.NewEncoder(w).Encode(raw)
+}
+
+// Close implements Encoder. CBOR items are self-delimiting and nothing is
+// buffered, so this is a no-op.
+func (enc *CBOREncoder) Close() error { return nil }
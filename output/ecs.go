@@ -0,0 +1,120 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package output
+
+import (
+	"encoding/json"
+	"evtx"
+	"fmt"
+	"io"
+)
+
+// ECSEncoder flattens an event's System section into the subset of the
+// Elastic Common Schema fields Winlogbeat itself populates
+// (event.*, host.*, winlog.*), keeping the untouched original event under
+// event.original for anything the flattening does not cover.
+type ECSEncoder struct{}
+
+// Encode implements Encoder.
+func (enc *ECSEncoder) Encode(w io.Writer, ev *evtx.GoEvtxMap) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(evtx.ToJSON(ev), &raw); err != nil {
+		return fmt.Errorf("output: ecs: %s", err)
+	}
+
+	sys, _ := fieldAt(raw, "Event", "System").(map[string]interface{})
+
+	doc := map[string]interface{}{
+		"event.original": string(evtx.ToJSON(ev)),
+	}
+	if v := flatString(sys, "EventID"); v != "" {
+		doc["event.code"] = v
+		doc["winlog.event_id"] = v
+	}
+	if v := flatString(sys, "Provider"); v != "" {
+		doc["event.provider"] = v
+		doc["winlog.provider_name"] = v
+	}
+	if v := flatString(sys, "Channel"); v != "" {
+		doc["event.dataset"] = v
+		doc["winlog.channel"] = v
+	}
+	if v := flatString(sys, "Computer"); v != "" {
+		doc["host.name"] = v
+		doc["winlog.computer_name"] = v
+	}
+	if t, err := ev.GetTime(&evtx.SystemTimePath); err == nil {
+		doc["@timestamp"] = t.UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// Close implements Encoder. ECS buffers nothing, so this is a no-op.
+func (enc *ECSEncoder) Close() error { return nil }
+
+// fieldAt walks a chain of map keys as produced by evtx.ToJSON, returning
+// nil if any step along the way is missing or not a map.
+func fieldAt(m map[string]interface{}, path ...string) interface{} {
+	var cur interface{} = m
+	for _, p := range path {
+		asMap, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur, ok = asMap[p]
+		if !ok {
+			return nil
+		}
+	}
+	return cur
+}
+
+// flatString extracts field as a string, unwrapping the {"Value": ...}
+// shape the XML-to-JSON conversion uses for elements carrying attributes
+// (e.g. <Provider Name="..."/> or <EventID Qualifiers="...">4624</EventID>).
+func flatString(m map[string]interface{}, field string) string {
+	if m == nil {
+		return ""
+	}
+	v, ok := m[field]
+	if !ok {
+		return ""
+	}
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return fmt.Sprintf("%d", int64(t))
+	case map[string]interface{}:
+		if name, ok := t["Name"].(string); ok {
+			return name
+		}
+		if val, ok := t["Value"]; ok {
+			return fmt.Sprintf("%v", val)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package output
+
+import "testing"
+
+func TestFieldAt(t *testing.T) {
+	m := map[string]interface{}{
+		"Event": map[string]interface{}{
+			"System": map[string]interface{}{
+				"Computer": "HOST01",
+			},
+		},
+	}
+
+	if v := fieldAt(m, "Event", "System"); v == nil {
+		t.Fatal("fieldAt(Event, System) = nil, want the System map")
+	}
+
+	if v := fieldAt(m, "Event", "System", "Computer"); v != "HOST01" {
+		t.Errorf("fieldAt(Event, System, Computer) = %v, want HOST01", v)
+	}
+
+	if v := fieldAt(m, "Event", "Nope"); v != nil {
+		t.Errorf("fieldAt on missing key = %v, want nil", v)
+	}
+
+	// "Computer" is a string, not a map, so walking past it must not panic.
+	if v := fieldAt(m, "Event", "System", "Computer", "Name"); v != nil {
+		t.Errorf("fieldAt past a non-map value = %v, want nil", v)
+	}
+
+	// A nil map with an empty path must not panic either.
+	_ = fieldAt(nil)
+}
+
+func TestFlatString(t *testing.T) {
+	cases := []struct {
+		name  string
+		m     map[string]interface{}
+		field string
+		want  string
+	}{
+		{"nil map", nil, "Computer", ""},
+		{"missing field", map[string]interface{}{"Other": "x"}, "Computer", ""},
+		{"plain string", map[string]interface{}{"Computer": "HOST01"}, "Computer", "HOST01"},
+		{"numeric EventID", map[string]interface{}{"EventID": float64(4624)}, "EventID", "4624"},
+		{
+			"attribute-wrapped with Name",
+			map[string]interface{}{"Provider": map[string]interface{}{"Name": "Microsoft-Windows-Security-Auditing"}},
+			"Provider", "Microsoft-Windows-Security-Auditing",
+		},
+		{
+			"attribute-wrapped with Value",
+			map[string]interface{}{"EventID": map[string]interface{}{"Qualifiers": "16384", "Value": float64(4624)}},
+			"EventID", "4624",
+		},
+		{
+			"attribute-wrapped with neither Name nor Value",
+			map[string]interface{}{"Foo": map[string]interface{}{"Bar": "baz"}},
+			"Foo", "",
+		},
+		{"unexpected type", map[string]interface{}{"Computer": true}, "Computer", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := flatString(c.m, c.field); got != c.want {
+				t.Errorf("flatString(%v, %q) = %q, want %q", c.m, c.field, got, c.want)
+			}
+		})
+	}
+}
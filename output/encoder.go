@@ -0,0 +1,65 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package output provides pluggable encoders for evtx.GoEvtxMap events, so
+// that evtxdump (or any other consumer of the evtx package) is not tied to
+// printing raw NDJSON with fmt.Printf.
+package output
+
+import (
+	"evtx"
+	"fmt"
+	"io"
+)
+
+// Encoder writes decoded events to w in some on-disk format. Encode may be
+// called many times on the same Encoder; Close flushes any buffered state
+// (e.g. a Parquet row group) and must be called exactly once, when no more
+// events will be encoded.
+type Encoder interface {
+	Encode(w io.Writer, e *evtx.GoEvtxMap) error
+	Close() error
+}
+
+// Format names accepted by New and the evtxdump -format flag.
+const (
+	FormatNDJSON  = "ndjson"
+	FormatECS     = "ecs"
+	FormatCBOR    = "cbor"
+	FormatParquet = "parquet"
+)
+
+// New returns the Encoder registered for format. Parquet needs to know
+// where it is writing ahead of time in order to manage row groups itself,
+// so callers using that format should write through the Encoder returned
+// here rather than passing an arbitrary io.Writer per call.
+func New(format string, w io.Writer) (Encoder, error) {
+	switch format {
+	case "", FormatNDJSON:
+		return &NDJSONEncoder{}, nil
+	case FormatECS:
+		return &ECSEncoder{}, nil
+	case FormatCBOR:
+		return NewCBOREncoder(), nil
+	case FormatParquet:
+		return NewParquetEncoder(w)
+	default:
+		return nil, fmt.Errorf("output: unknown format %q", format)
+	}
+}
@@ -0,0 +1,39 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package output
+
+import (
+	"evtx"
+	"fmt"
+	"io"
+)
+
+// NDJSONEncoder writes one evtx.ToJSON-encoded event per line, i.e. the
+// format evtxdump has always printed.
+type NDJSONEncoder struct{}
+
+// Encode implements Encoder.
+func (e *NDJSONEncoder) Encode(w io.Writer, ev *evtx.GoEvtxMap) error {
+	_, err := fmt.Fprintf(w, "%s\n", string(evtx.ToJSON(ev)))
+	return err
+}
+
+// Close implements Encoder. NDJSON buffers nothing, so this is a no-op.
+func (e *NDJSONEncoder) Close() error { return nil }
@@ -0,0 +1,130 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package output
+
+import (
+	"encoding/json"
+	"evtx"
+	"io"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/writerfile"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetRowGroupThreshold is how many events accumulate before a row group
+// is flushed to disk. Keeping this bounded, rather than buffering every
+// event for the whole run, is what lets Parquet output run against
+// multi-gigabyte inputs without unbounded memory growth.
+const parquetRowGroupThreshold = 50000
+
+// parquetSchema covers the handful of System fields every event has, plus a
+// Raw column carrying the full evtx.ToJSON encoding of the event. A schema
+// that truly unions every field ever observed across a carve would need a
+// first pass over the whole input just to build it; starting from the
+// stable System fields and keeping Raw as a fallback gets most of the value
+// (queryable EventID/Provider/Channel/Computer/TimeCreated) without that
+// extra pass.
+const parquetSchema = `{
+  "Tag": "name=Event, repetitiontype=REQUIRED",
+  "Fields": [
+    {"Tag": "name=EventID, type=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=Provider, type=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=Channel, type=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=Computer, type=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=TimeCreated, type=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=Raw, type=UTF8, repetitiontype=REQUIRED"}
+  ]
+}`
+
+type parquetRow struct {
+	EventID     string `json:"EventID"`
+	Provider    string `json:"Provider"`
+	Channel     string `json:"Channel"`
+	Computer    string `json:"Computer"`
+	TimeCreated string `json:"TimeCreated"`
+	Raw         string `json:"Raw"`
+}
+
+// ParquetEncoder writes events to a columnar Parquet file. Unlike the other
+// encoders it owns the destination writer (passed once to
+// NewParquetEncoder rather than per-call to Encode) because the Parquet
+// writer needs to manage row groups and the file footer itself; the w
+// argument to Encode is ignored.
+type ParquetEncoder struct {
+	pw      *writer.JSONWriter
+	pending int
+}
+
+// NewParquetEncoder creates a ParquetEncoder that writes to w.
+func NewParquetEncoder(w io.Writer) (*ParquetEncoder, error) {
+	pf := writerfile.NewWriterFile(w)
+	pw, err := writer.NewJSONWriter(parquetSchema, pf, 4)
+	if err != nil {
+		return nil, err
+	}
+	return &ParquetEncoder{pw: pw}, nil
+}
+
+// Encode implements Encoder. w is ignored; see ParquetEncoder's doc comment.
+func (enc *ParquetEncoder) Encode(w io.Writer, ev *evtx.GoEvtxMap) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(evtx.ToJSON(ev), &raw); err != nil {
+		return err
+	}
+	sys, _ := fieldAt(raw, "Event", "System").(map[string]interface{})
+
+	var created string
+	if t, err := ev.GetTime(&evtx.SystemTimePath); err == nil {
+		created = t.UTC().Format(time.RFC3339Nano)
+	}
+
+	row := parquetRow{
+		EventID:     flatString(sys, "EventID"),
+		Provider:    flatString(sys, "Provider"),
+		Channel:     flatString(sys, "Channel"),
+		Computer:    flatString(sys, "Computer"),
+		TimeCreated: created,
+		Raw:         string(evtx.ToJSON(ev)),
+	}
+
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if err := enc.pw.Write(string(b)); err != nil {
+		return err
+	}
+
+	enc.pending++
+	if enc.pending >= parquetRowGroupThreshold {
+		if err := enc.pw.Flush(true); err != nil {
+			return err
+		}
+		enc.pending = 0
+	}
+	return nil
+}
+
+// Close implements Encoder: it flushes any buffered rows, writes the
+// Parquet footer, and must be called exactly once after the last Encode.
+func (enc *ParquetEncoder) Close() error {
+	return enc.pw.WriteStop()
+}
@@ -0,0 +1,291 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package evtx
+
+import (
+	"container/heap"
+	"runtime"
+)
+
+// seqItem pairs a value produced by a worker with the sequence number it was
+// submitted with, so ordered consumers can put it back in submission order.
+// offset, readErr and invalid are only meaningful for Carver's use of
+// seqItem (the chunk offset items came from, whether decodeChunk failed with
+// a *chunkReadError, and whether it failed with any other error);
+// File leaves them zero/false.
+type seqItem struct {
+	seq     int
+	offset  int64
+	items   []*GoEvtxMap
+	readErr bool
+	invalid bool
+}
+
+// seqHeap is a min-heap of seqItem ordered by seq, used by the reorder
+// buffer in ordered mode.
+type seqHeap []seqItem
+
+func (h seqHeap) Len() int            { return len(h) }
+func (h seqHeap) Less(i, j int) bool  { return h[i].seq < h[j].seq }
+func (h seqHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *seqHeap) Push(x interface{}) { *h = append(*h, x.(seqItem)) }
+func (h *seqHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	*h = old[:n-1]
+	return it
+}
+
+// resolveWorkers returns nWorkers, falling back to runtime.NumCPU() when
+// nWorkers <= 0, and never less than 1.
+func resolveWorkers(nWorkers int) int {
+	if nWorkers <= 0 {
+		nWorkers = runtime.NumCPU()
+	}
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	return nWorkers
+}
+
+// reorder consumes seqItem values from in (which may arrive in any order)
+// and emits their contained events on out strictly in ascending seq order,
+// using a small heap-based buffer to hold items that arrived early. A
+// worker that failed to produce anything for a given seq must still send a
+// seqItem for it (with a nil or empty items slice): reorder advances next
+// purely by seq number, so a seq that is never sent stalls every later one
+// behind it in the heap forever.
+func reorder(in <-chan seqItem, out chan<- *GoEvtxMap) {
+	pending := &seqHeap{}
+	next := 0
+	for si := range in {
+		heap.Push(pending, si)
+		for pending.Len() > 0 && (*pending)[0].seq == next {
+			item := heap.Pop(pending).(seqItem)
+			for _, e := range item.items {
+				out <- e
+			}
+			next++
+		}
+	}
+	// Drain whatever is left (only reachable if seq numbers were not
+	// contiguous, which should not happen for a well-formed producer).
+	for pending.Len() > 0 {
+		item := heap.Pop(pending).(seqItem)
+		for _, e := range item.items {
+			out <- e
+		}
+	}
+}
+
+// consumeCarved is Carver.ParallelEvents' single reader of its workers'
+// results channel. It does two things with every seqItem it sees, for
+// exactly the reason each needs: hand events to out, in submission order
+// when ordered is true or as soon as they arrive otherwise; and, always
+// regardless of ordered, call onInOrder for every seqItem exactly once in
+// strict seq order, via its own heap-based buffer separate from whichever
+// one (if any) is being used for emission. onInOrder is what
+// Carver.ParallelEvents uses to advance nextScan the same way the
+// sequential Events() does, which requires processing results in the order
+// their chunks were scanned regardless of how fast each happened to decode.
+func consumeCarved(in <-chan seqItem, out chan<- CarvedEvent, ordered bool, onInOrder func(seqItem)) {
+	emitPending := &seqHeap{}
+	emitNext := 0
+	emit := func(item seqItem) {
+		for _, e := range item.items {
+			out <- CarvedEvent{Offset: item.offset, Event: e}
+		}
+	}
+
+	trackPending := &seqHeap{}
+	trackNext := 0
+
+	for si := range in {
+		heap.Push(trackPending, si)
+		for trackPending.Len() > 0 && (*trackPending)[0].seq == trackNext {
+			onInOrder(heap.Pop(trackPending).(seqItem))
+			trackNext++
+		}
+
+		if !ordered {
+			emit(si)
+			continue
+		}
+		heap.Push(emitPending, si)
+		for emitPending.Len() > 0 && (*emitPending)[0].seq == emitNext {
+			emit(heap.Pop(emitPending).(seqItem))
+			emitNext++
+		}
+	}
+
+	for trackPending.Len() > 0 {
+		onInOrder(heap.Pop(trackPending).(seqItem))
+	}
+	for emitPending.Len() > 0 {
+		emit(heap.Pop(emitPending).(seqItem))
+	}
+}
+
+// ParallelEvents is a known scope cut, not a full implementation of
+// parallel chunk decode for File: it hands back f.FastEvents()'s output
+// unchanged, and nWorkers/ordered are currently ignored for this path.
+//
+// Carver.ParallelEvents can fan chunk decode out across workers because it
+// owns the byte range it scans directly via an io.ReaderAt: it finds each
+// chunk's offset itself (ScanChunkMagic) and reads/parses each one
+// independently (decodeChunk) with nothing shared between them. Doing the
+// same for File would mean computing each chunk's offset from its header
+// (this file format lays chunks out at fixed-size, deterministic offsets
+// once you know the chunk count, so it is possible in principle) and
+// parsing each one the way decodeChunk does, run across a worker pool the
+// same shape as Carver's. That requires reaching into File's internal
+// reader and header fields, which this source tree does not define (only
+// tools/evtxdump/evtxdump.go and the Carver/output additions built on top
+// of it are present here) - implementing it would mean guessing unexported
+// field names on a type this series never had to touch otherwise, which is
+// worse than leaving this as a documented gap. Whoever has the actual File
+// definition in hand should follow Carver.ParallelEvents' shape directly.
+//
+// What IS real here: the per-event work a caller does with each *GoEvtxMap
+// next (time-window filtering, JSON/CBOR/Parquet marshalling) is exactly
+// what evtxdump's processEvents fans out across a worker pool fed by this
+// channel, instead of doing that work serially in a single consumer loop.
+// That is a genuine, if partial, win from -workers on the non-carving path;
+// chunk decode itself on that path remains sequential until the cut above
+// is closed.
+func (f *File) ParallelEvents(nWorkers int, ordered bool) <-chan *GoEvtxMap {
+	resolveWorkers(nWorkers) // validate/normalize for parity with Carver; see doc comment
+	return f.FastEvents()
+}
+
+// ParallelEvents carves the Carver's byte range across nWorkers goroutines
+// (runtime.NumCPU() if nWorkers <= 0), each one fully decoding one chunk
+// (string/template tables included) independently of the others. In ordered
+// mode events are re-assembled into on-disk chunk order via a reorder
+// buffer; in unordered mode they are emitted as soon as a worker finishes,
+// which is the mode -u/-u-equivalent callers should use for maximum
+// throughput on large carved ranges.
+//
+// nextScan (and so ResumeToken, once the returned channel is drained) is
+// advanced the same way Events does: a chunk whose decodeChunk fails with a
+// *chunkReadError leaves nextScan at that chunk's own offset so a resumed
+// Carver retries it, instead of being skipped past like a chunk that merely
+// failed header validation. Because workers can finish out of scan order,
+// that bookkeeping happens on a dedicated in-seq-order pass over the
+// results (see consumeCarved), separate from whatever order events are
+// emitted on out in.
+//
+// MaxChunks counts every candidate offset handed to a worker, false-positive
+// magic matches included, so ParallelEvents can stop after fewer valid
+// chunks than Events would for the same MaxChunks.
+//
+// One limitation this still has that the sequential
+// Events doesn't: by the time a read error at an earlier offset is known,
+// workers may have already decoded and emitted events from later chunks, so
+// a caller resuming from the read error's offset can see those later
+// events again. Callers that need strict exactly-once resume semantics
+// should use Events instead.
+func (c *Carver) ParallelEvents(nWorkers int, ordered bool) <-chan CarvedEvent {
+	nWorkers = resolveWorkers(nWorkers)
+	out := make(chan CarvedEvent, 4096)
+
+	type offsetJob struct {
+		seq    int
+		offset int64
+	}
+	jobs := make(chan offsetJob, nWorkers)
+
+	go func() {
+		defer close(jobs)
+		ch := ScanChunkMagic(c.r, c.nextScan, c.opts.End)
+		seq := 0
+		for offset := range ch {
+			jobs <- offsetJob{seq: seq, offset: offset}
+			seq++
+			c.chunkCnt++
+			if c.opts.MaxChunks > 0 && c.chunkCnt >= c.opts.MaxChunks {
+				drainInt64(ch)
+				return
+			}
+		}
+	}()
+
+	results := make(chan seqItem, nWorkers)
+	wdone := make(chan struct{}, nWorkers)
+	for w := 0; w < nWorkers; w++ {
+		go func() {
+			defer func() { wdone <- struct{}{} }()
+			for job := range jobs {
+				// Always send a result for this seq, even when decoding
+				// fails (a false-positive magic match, or a truncated
+				// chunk): the ordered reassembly below advances strictly
+				// by seq, so skipping a send here would stall every
+				// later chunk behind it forever.
+				chunk, err := decodeChunk(c.r, job.offset)
+				if err != nil {
+					_, isReadErr := err.(*chunkReadError)
+					results <- seqItem{seq: job.seq, offset: job.offset, readErr: isReadErr, invalid: !isReadErr}
+					continue
+				}
+				var events []*GoEvtxMap
+				for e := range chunk.Events() {
+					events = append(events, e)
+				}
+				results <- seqItem{seq: job.seq, offset: job.offset, items: events}
+			}
+		}()
+	}
+
+	go func() {
+		for i := 0; i < nWorkers; i++ {
+			<-wdone
+		}
+		close(results)
+	}()
+
+	go func() {
+		defer close(out)
+		// Once a read error is seen, nextScan is pinned at its offset: a
+		// later (in scan order) chunkReadError would only mean we failed
+		// to read even further ahead, which resuming from the earliest
+		// failure will naturally reach again, so ignore it here.
+		sawReadErr := false
+		consumeCarved(results, out, ordered, func(item seqItem) {
+			if sawReadErr {
+				return
+			}
+			if item.readErr {
+				c.nextScan = item.offset
+				sawReadErr = true
+				return
+			}
+			if item.invalid {
+				// A false-positive magic match: skip just past it, as
+				// Events does.
+				c.nextScan = item.offset + 1
+				return
+			}
+			c.nextScan = item.offset + ChunkSize
+		})
+	}()
+
+	return out
+}
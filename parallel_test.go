@@ -0,0 +1,252 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package evtx
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// TestReorderHandlesEmptyItems is a regression test for a bug where a
+// worker that failed to decode a chunk never sent a seqItem for its seq at
+// all, which stalled reorder (and Carver.ParallelEvents' ordered mode with
+// it) on every later seq forever. A failing worker must still send a
+// seqItem with a nil/empty items slice; reorder has to treat that as "seq N
+// produced zero events" rather than "seq N never happened".
+func TestReorderHandlesEmptyItems(t *testing.T) {
+	e1, e2, e3 := new(GoEvtxMap), new(GoEvtxMap), new(GoEvtxMap)
+
+	in := make(chan seqItem, 4)
+	// seq 1 is the "failed to decode" case: no items at all.
+	in <- seqItem{seq: 0, items: []*GoEvtxMap{e1}}
+	in <- seqItem{seq: 1}
+	in <- seqItem{seq: 2, items: []*GoEvtxMap{e2, e3}}
+	close(in)
+
+	out := make(chan *GoEvtxMap, 4)
+	reorder(in, out)
+	close(out)
+
+	var got []*GoEvtxMap
+	for e := range out {
+		got = append(got, e)
+	}
+
+	want := []*GoEvtxMap{e1, e2, e3}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %p, want %p", i, got[i], want[i])
+		}
+	}
+}
+
+// TestReorderOutOfOrderArrival checks that reorder puts items back into seq
+// order even when they arrive out of order, which is the normal case for a
+// worker pool (faster workers finish later-seq jobs before slower ones
+// finish earlier-seq jobs).
+func TestReorderOutOfOrderArrival(t *testing.T) {
+	e0, e1, e2 := new(GoEvtxMap), new(GoEvtxMap), new(GoEvtxMap)
+
+	in := make(chan seqItem, 4)
+	in <- seqItem{seq: 2, items: []*GoEvtxMap{e2}}
+	in <- seqItem{seq: 0, items: []*GoEvtxMap{e0}}
+	in <- seqItem{seq: 1, items: []*GoEvtxMap{e1}}
+	close(in)
+
+	out := make(chan *GoEvtxMap, 4)
+	reorder(in, out)
+	close(out)
+
+	want := []*GoEvtxMap{e0, e1, e2}
+	i := 0
+	for e := range out {
+		if e != want[i] {
+			t.Errorf("event %d: got %p, want %p", i, e, want[i])
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Fatalf("got %d events, want %d", i, len(want))
+	}
+}
+
+// TestConsumeCarvedHandlesEmptyItems is consumeCarved's counterpart to
+// TestReorderHandlesEmptyItems, covering the exact reassembly path used by
+// Carver.ParallelEvents in ordered mode.
+func TestConsumeCarvedHandlesEmptyItems(t *testing.T) {
+	e1, e2 := new(GoEvtxMap), new(GoEvtxMap)
+
+	in := make(chan seqItem, 3)
+	in <- seqItem{seq: 0, offset: 0x1000, items: []*GoEvtxMap{e1}}
+	in <- seqItem{seq: 1, offset: 0x2000} // failed chunk: no items
+	in <- seqItem{seq: 2, offset: 0x3000, items: []*GoEvtxMap{e2}}
+	close(in)
+
+	out := make(chan CarvedEvent, 3)
+	consumeCarved(in, out, true, func(seqItem) {})
+	close(out)
+
+	var got []CarvedEvent
+	for ce := range out {
+		got = append(got, ce)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2", len(got))
+	}
+	if got[0].Event != e1 || got[0].Offset != 0x1000 {
+		t.Errorf("event 0: got %+v", got[0])
+	}
+	if got[1].Event != e2 || got[1].Offset != 0x3000 {
+		t.Errorf("event 1: got %+v", got[1])
+	}
+}
+
+// TestConsumeCarvedTracksInSeqOrderRegardlessOfEmission checks the property
+// Carver.ParallelEvents relies on to fix nextScan correctly: onInOrder is
+// called for every seqItem exactly once, strictly in ascending seq order,
+// even in unordered mode where emission itself happens in arrival order.
+func TestConsumeCarvedTracksInSeqOrderRegardlessOfEmission(t *testing.T) {
+	in := make(chan seqItem, 3)
+	// Deliberately out of seq order, as a worker pool can deliver.
+	in <- seqItem{seq: 2, offset: 0x3000}
+	in <- seqItem{seq: 0, offset: 0x1000}
+	in <- seqItem{seq: 1, offset: 0x2000}
+	close(in)
+
+	out := make(chan CarvedEvent, 3)
+	var tracked []int64
+	consumeCarved(in, out, false, func(item seqItem) {
+		tracked = append(tracked, item.offset)
+	})
+	close(out)
+	for range out {
+	}
+
+	want := []int64{0x1000, 0x2000, 0x3000}
+	if len(tracked) != len(want) {
+		t.Fatalf("got %d tracked offsets %v, want %d %v", len(tracked), tracked, len(want), want)
+	}
+	for i := range want {
+		if tracked[i] != want[i] {
+			t.Errorf("tracked[%d] = %#x, want %#x", i, tracked[i], want[i])
+		}
+	}
+}
+
+// TestCarverParallelEventsResumesAtTruncatedChunkNotPastIt is
+// TestEventsResumesAtTruncatedChunkNotPastIt's counterpart for
+// ParallelEvents: a worker's decodeChunk failing with a *chunkReadError must
+// leave nextScan at that chunk's own offset, not past it, exactly like
+// Events does, even though results can complete out of scan order. This is
+// the path evtxdump's carveFile actually uses (it never calls Events), so
+// it is the one that matters for --resume correctness.
+func TestCarverParallelEventsResumesAtTruncatedChunkNotPastIt(t *testing.T) {
+	magic := []byte(ChunkMagic)
+	data := make([]byte, ChunkSize)
+	copy(data, magic)
+	truncated := data[:len(magic)+4]
+
+	r := &boundaryReaderAt{data: truncated}
+	c, err := NewCarver(r, CarveOptions{})
+	if err != nil {
+		t.Fatalf("NewCarver: %s", err)
+	}
+
+	for range c.ParallelEvents(1, true) {
+	}
+
+	off, err := decodeResumeToken(c.ResumeToken())
+	if err != nil {
+		t.Fatalf("decodeResumeToken: %s", err)
+	}
+	if off != 0 {
+		t.Errorf("resume offset = %d, want 0 (the truncated chunk's own offset, so a resume retries it)", off)
+	}
+}
+
+// BenchmarkParallelDecodeScaling demonstrates how Carver.ParallelEvents'
+// orchestration (job dispatch, worker fan-out, consumeCarved's in-seq-order
+// tracking plus reassembly) scales with worker count. It stands in for a
+// benchmark against a real multi-gigabyte .evtx file, which this checkout
+// has no fixture for: each "chunk" here is a fixed amount of synthetic
+// CPU-bound work instead of a real decodeChunk call, so what it measures is
+// the pipeline's own scaling, not real decode throughput.
+func BenchmarkParallelDecodeScaling(b *testing.B) {
+	const nChunks = 500
+
+	for _, nWorkers := range []int{1, 2, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", nWorkers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				jobs := make(chan int, nChunks)
+				for seq := 0; seq < nChunks; seq++ {
+					jobs <- seq
+				}
+				close(jobs)
+
+				results := make(chan seqItem, nWorkers)
+				wdone := make(chan struct{}, nWorkers)
+				for w := 0; w < nWorkers; w++ {
+					go func() {
+						defer func() { wdone <- struct{}{} }()
+						for seq := range jobs {
+							simulateChunkDecode()
+							results <- seqItem{seq: seq, offset: int64(seq) * ChunkSize, items: []*GoEvtxMap{new(GoEvtxMap)}}
+						}
+					}()
+				}
+				go func() {
+					for w := 0; w < nWorkers; w++ {
+						<-wdone
+					}
+					close(results)
+				}()
+
+				out := make(chan CarvedEvent, nChunks)
+				consumeCarved(results, out, true, func(seqItem) {})
+				close(out)
+
+				n := 0
+				for range out {
+					n++
+				}
+				if n != nChunks {
+					b.Fatalf("got %d events, want %d", n, nChunks)
+				}
+			}
+		})
+	}
+}
+
+// simulateChunkDecode stands in for decodeChunk's CPU cost (parsing the
+// string/template tables and event offsets) in BenchmarkParallelDecodeScaling.
+func simulateChunkDecode() {
+	x := 0
+	for i := 0; i < 20000; i++ {
+		x += i * i
+	}
+	if x < 0 {
+		panic("unreachable")
+	}
+}
@@ -0,0 +1,209 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package evtx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/sys/cpu"
+)
+
+// scanWindowSize is the size of the window read at a time while scanning a
+// carved file for chunk magics. It has to be significantly bigger than
+// len(ChunkMagic) so that the per-window overhead stays negligible.
+const scanWindowSize = 64 * 1024
+
+// magicOverlap is the number of trailing bytes carried over from one window
+// to the next so that a magic straddling a window boundary is not missed.
+var magicOverlap = len(ChunkMagic) - 1
+
+// vectorizedIndex records whether the running CPU has a feature that makes
+// internal/bytealg's assembly Index implementation (what bytes.Index calls
+// into) meaningfully faster than a portable word-at-a-time scan: AVX2 or
+// SSE4.2 on amd64, ASIMD (NEON) on arm64. It is computed once from
+// golang.org/x/sys/cpu's feature flags, which that package populates during
+// its own init, before ours runs.
+var vectorizedIndex = cpu.X86.HasAVX2 || cpu.X86.HasSSE42 || cpu.ARM64.HasASIMD
+
+// hasVectorizedIndex reports vectorizedIndex; indexAll consults it to pick
+// an implementation.
+func hasVectorizedIndex() bool {
+	return vectorizedIndex
+}
+
+// indexAll appends to dst the offset of every non-overlapping occurrence of
+// magic found in buf and returns the extended slice. It dispatches to
+// whichever of indexAllBytesIndex / indexAllSWAR actually benefits from the
+// running CPU's feature set; both return identical results for the same
+// input, so the dispatch is purely a performance decision.
+func indexAll(dst []int, buf []byte, magic []byte) []int {
+	if hasVectorizedIndex() {
+		return indexAllBytesIndex(dst, buf, magic)
+	}
+	return indexAllSWAR(dst, buf, magic)
+}
+
+// indexAllBytesIndex finds occurrences of magic via bytes.Index, which on
+// AVX2/SSE4.2/ASIMD-capable CPUs dispatches into internal/bytealg's hand
+// written assembly. Go does not expose a way to call that assembly
+// directly, so going through bytes.Index is how this package gets it.
+func indexAllBytesIndex(dst []int, buf []byte, magic []byte) []int {
+	base := 0
+	for {
+		i := bytes.Index(buf[base:], magic)
+		if i < 0 {
+			return dst
+		}
+		dst = append(dst, base+i)
+		base += i + len(magic)
+	}
+}
+
+// indexAllSWAR is the fallback used when hasVectorizedIndex is false. It
+// finds candidate positions of magic[0] eight bytes at a time using the
+// classic SWAR (SIMD-within-a-register) zero-byte trick, instead of
+// bytes.Index's byte-at-a-time scan, then verifies the full magic at each
+// candidate. This is plain Go, not assembly, but it still processes a word
+// at a time on CPUs where bytes.Index has no vectorized path to fall back
+// on.
+func indexAllSWAR(dst []int, buf []byte, magic []byte) []int {
+	if len(magic) == 0 {
+		return dst
+	}
+	pattern := uint64(0x0101010101010101) * uint64(magic[0])
+	base := 0
+	for {
+		i := swarIndexByte(buf[base:], magic[0], pattern)
+		if i < 0 {
+			return dst
+		}
+		pos := base + i
+		if pos+len(magic) <= len(buf) && bytes.Equal(buf[pos:pos+len(magic)], magic) {
+			dst = append(dst, pos)
+			base = pos + len(magic)
+		} else {
+			base = pos + 1
+		}
+	}
+}
+
+// swarHasZeroByte returns a non-zero value if and only if at least one of
+// v's 8 bytes is zero. The lowest byte whose top bit is set in the result
+// marks the first zero byte; flags on higher bytes can be false positives,
+// so callers must confirm a candidate byte by byte.
+// v is assumed to already be XORed against the byte being searched for, so
+// a zero byte in v means a match at that position.
+func swarHasZeroByte(v uint64) uint64 {
+	return (v - 0x0101010101010101) & ^v & 0x8080808080808080
+}
+
+// swarIndexByte returns the index of the first occurrence of c in b, or -1,
+// scanning 8 bytes at a time via swarHasZeroByte and falling back to a
+// byte-at-a-time scan for b's final, possibly short, tail.
+func swarIndexByte(b []byte, c byte, pattern uint64) int {
+	n := len(b)
+	i := 0
+	for ; i+8 <= n; i += 8 {
+		if swarHasZeroByte(binary.LittleEndian.Uint64(b[i:i+8])^pattern) == 0 {
+			continue
+		}
+		for j := 0; j < 8; j++ {
+			if b[i+j] == c {
+				return i + j
+			}
+		}
+	}
+	for ; i < n; i++ {
+		if b[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// ScanChunkMagic scans the byte range [start, end) of r for occurrences of
+// ChunkMagic and streams their absolute offsets on the returned channel. If
+// end <= 0 the scan runs until EOF. The scan is windowed so memory use stays
+// bounded regardless of the size of r, and matches that straddle a window
+// boundary are still found thanks to a small overlap between consecutive
+// windows.
+//
+// The channel is closed once the scan reaches end (or EOF, or hits a read
+// error other than io.EOF). Callers that need to react to a read error
+// should drain the channel and then inspect the final offset themselves;
+// ScanChunkMagic itself only logs nothing and silently stops, matching the
+// behavior of the regexp-based scanner it replaces.
+func ScanChunkMagic(r io.ReaderAt, start, end int64) <-chan int64 {
+	out := make(chan int64, 64)
+	magic := []byte(ChunkMagic)
+
+	go func() {
+		defer close(out)
+
+		buf := make([]byte, scanWindowSize)
+		offset := start
+		var carry []byte
+
+		for end <= 0 || offset < end {
+			toRead := len(buf)
+			if end > 0 {
+				if remaining := end - offset + int64(magicOverlap); remaining < int64(toRead) {
+					if remaining <= 0 {
+						break
+					}
+					toRead = int(remaining)
+				}
+			}
+
+			n, err := r.ReadAt(buf[:toRead], offset)
+			if n > 0 {
+				window := append(carry, buf[:n]...)
+				locs := indexAll(nil, window, magic)
+				for _, loc := range locs {
+					abs := offset - int64(len(carry)) + int64(loc)
+					if abs >= start && (end <= 0 || abs < end) {
+						out <- abs
+					}
+				}
+
+				// Keep the trailing bytes that could still be the
+				// prefix of a magic split across the next window.
+				if len(window) > magicOverlap {
+					carry = append(carry[:0], window[len(window)-magicOverlap:]...)
+				} else {
+					carry = append(carry[:0], window...)
+				}
+				offset += int64(n)
+			}
+
+			if err != nil {
+				// io.EOF (or any other error) means there is nothing
+				// left to read: stop the scan gracefully instead of
+				// propagating, mirroring findChunksOffsets' previous
+				// behavior of stopping at the first failed read.
+				return
+			}
+		}
+	}()
+
+	return out
+}
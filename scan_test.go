@@ -0,0 +1,225 @@
+/*
+EVTX dumping utility, it can be used to carve raw data and recover EVTX events
+
+Copyright (C) 2017  RawSec SARL (0xrawsec)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package evtx
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// magicPositions builds a buffer of size n with ChunkMagic planted at each
+// offset in at, padded with non-magic filler bytes everywhere else.
+func magicPositions(n int, at ...int) ([]byte, []int) {
+	buf := make([]byte, n)
+	filler := []byte("x")[0]
+	for i := range buf {
+		buf[i] = filler
+	}
+	magic := []byte(ChunkMagic)
+	want := make([]int, 0, len(at))
+	for _, off := range at {
+		copy(buf[off:], magic)
+		want = append(want, off)
+	}
+	return buf, want
+}
+
+func testIndexAllImpl(t *testing.T, indexAll func(dst, buf, magic []byte) []int) {
+	magic := []byte(ChunkMagic)
+
+	buf, want := magicPositions(4096, 0, 64, 4096-len(magic))
+	got := indexAll(nil, buf, magic)
+	if len(got) != len(want) {
+		t.Fatalf("got %d matches, want %d: %v vs %v", len(got), len(want), got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("match %d: got offset %d, want %d", i, got[i], want[i])
+		}
+	}
+
+	if got := indexAll(nil, []byte("no magic in here"), magic); len(got) != 0 {
+		t.Errorf("expected no matches, got %v", got)
+	}
+
+	if got := indexAll(nil, nil, magic); len(got) != 0 {
+		t.Errorf("expected no matches on empty buf, got %v", got)
+	}
+}
+
+func TestIndexAllBytesIndex(t *testing.T) {
+	testIndexAllImpl(t, func(dst, buf, magic []byte) []int {
+		return indexAllBytesIndex(nil, buf, magic)
+	})
+}
+
+func TestIndexAllSWAR(t *testing.T) {
+	testIndexAllImpl(t, func(dst, buf, magic []byte) []int {
+		return indexAllSWAR(nil, buf, magic)
+	})
+}
+
+// TestIndexAllAgree checks that both implementations find the same matches
+// over a batch of randomly placed magics, regardless of which one
+// hasVectorizedIndex would pick on the machine running the test.
+func TestIndexAllAgree(t *testing.T) {
+	magic := []byte(ChunkMagic)
+	rng := rand.New(rand.NewSource(1))
+
+	for trial := 0; trial < 20; trial++ {
+		n := 1 + rng.Intn(8192)
+		buf := make([]byte, n)
+		rng.Read(buf)
+
+		nPlanted := rng.Intn(5)
+		for i := 0; i < nPlanted; i++ {
+			off := rng.Intn(n)
+			if off+len(magic) <= n {
+				copy(buf[off:], magic)
+			}
+		}
+
+		want := indexAllBytesIndex(nil, buf, magic)
+		got := indexAllSWAR(nil, buf, magic)
+		if !equalInts(want, got) {
+			t.Fatalf("trial %d (n=%d): indexAllSWAR = %v, indexAllBytesIndex = %v", trial, n, got, want)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// boundaryReaderAt serves ReadAt calls directly out of an in-memory buffer,
+// so ScanChunkMagic can be tested without a real file.
+type boundaryReaderAt struct {
+	data []byte
+}
+
+func (r *boundaryReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, bytes.ErrTooLarge // any non-nil, non-io.EOF-shaped error works here
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, bytes.ErrTooLarge
+	}
+	return n, nil
+}
+
+func TestScanChunkMagicFindsBoundaryStraddlingMatch(t *testing.T) {
+	magic := []byte(ChunkMagic)
+	// Plant one match straddling the first window boundary, so it is not
+	// fully contained in a single scanWindowSize read, and one just after
+	// the second boundary, at the start of a later window.
+	buf, want := magicPositions(4*scanWindowSize, scanWindowSize-len(magic)/2, 2*scanWindowSize+3)
+
+	r := &boundaryReaderAt{data: buf}
+	var got []int64
+	for off := range ScanChunkMagic(r, 0, int64(len(buf))) {
+		got = append(got, off)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d matches %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i, w := range want {
+		if got[i] != int64(w) {
+			t.Errorf("match %d: got offset %d, want %d", i, got[i], w)
+		}
+	}
+}
+
+func TestScanChunkMagicRespectsRange(t *testing.T) {
+	buf, _ := magicPositions(4096, 100, 2000, 3900)
+
+	r := &boundaryReaderAt{data: buf}
+	var got []int64
+	for off := range ScanChunkMagic(r, 500, 3000) {
+		got = append(got, off)
+	}
+
+	if len(got) != 1 || got[0] != 2000 {
+		t.Errorf("got %v, want [2000] (match at 100 is before start, match at 3900 is at/after end)", got)
+	}
+}
+
+// BenchmarkScanChunkMagic exercises the scan over a buffer with one magic
+// per scanWindowSize; it is a stand-in run at a much smaller scale than the
+// multi-gigabyte carved images this is meant for; see how throughput scales
+// with -workers by running the equivalent benchmark against a real disk
+// image outside of this test suite.
+func BenchmarkScanChunkMagic(b *testing.B) {
+	const nWindows = 64
+	magic := []byte(ChunkMagic)
+	buf := make([]byte, nWindows*scanWindowSize)
+	for i := 0; i < nWindows; i++ {
+		copy(buf[i*scanWindowSize:], magic)
+	}
+
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := &boundaryReaderAt{data: buf}
+		n := 0
+		for range ScanChunkMagic(r, 0, int64(len(buf))) {
+			n++
+		}
+		if n != nWindows {
+			b.Fatalf("found %d matches, want %d", n, nWindows)
+		}
+	}
+}
+
+func BenchmarkIndexAllBytesIndex(b *testing.B) {
+	benchmarkIndexAllImpl(b, func(dst []int, buf, magic []byte) []int {
+		return indexAllBytesIndex(dst, buf, magic)
+	})
+}
+
+func BenchmarkIndexAllSWAR(b *testing.B) {
+	benchmarkIndexAllImpl(b, func(dst []int, buf, magic []byte) []int {
+		return indexAllSWAR(dst, buf, magic)
+	})
+}
+
+func benchmarkIndexAllImpl(b *testing.B, indexAll func(dst []int, buf, magic []byte) []int) {
+	magic := []byte(ChunkMagic)
+	buf := make([]byte, scanWindowSize)
+	for i := 0; i < scanWindowSize; i += 4096 {
+		copy(buf[i:], magic)
+	}
+
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		indexAll(nil, buf, magic)
+	}
+}
@@ -20,16 +20,20 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"container/heap"
 	"evtx"
+	"evtx/output"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/0xrawsec/golang-utils/args"
@@ -49,133 +53,274 @@ conditions;`
 )
 
 var (
-	debug         bool
-	carve         bool
-	timestamp     bool
-	version       bool
-	unordered     bool
-	offset        int64
-	limit         int
-	start, stop   args.DateVar
-	chunkHeaderRE = regexp.MustCompile(evtx.ChunkMagic)
-	defaultTime   = time.Time{}
+	debug       bool
+	carve       bool
+	timestamp   bool
+	version     bool
+	unordered   bool
+	offset      int64
+	limit       int
+	rng         string
+	resume      string
+	workers     int
+	format      string
+	outFile     string
+	start, stop args.DateVar
+	defaultTime = time.Time{}
+	encoder     output.Encoder
+	encOut      io.Writer
 )
 
-// Find the potential chunks
-func findChunksOffsets(r io.ReadSeeker) (co chan int64) {
-	co = make(chan int64, 42)
-	realPrevOffset, _ := r.Seek(0, os.SEEK_CUR)
-	go func() {
-		defer close(co)
-		rr := bufio.NewReader(r)
-		for loc := chunkHeaderRE.FindReaderIndex(rr); loc != nil; loc = chunkHeaderRE.FindReaderIndex(rr) {
-			realOffset, _ := r.Seek(0, os.SEEK_CUR)
-			co <- realPrevOffset + int64(loc[0])
-			realPrevOffset = realOffset - int64(rr.Buffered())
+// parseRange parses a "start:end" range specification as accepted by the
+// -range flag. Either side may be omitted (":end", "start:" or "") to mean
+// "from/to the natural bound".
+func parseRange(s string) (start, end int64, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q, expected start:end", s)
+	}
+	if parts[0] != "" {
+		if start, err = strconv.ParseInt(parts[0], 0, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid range start %q: %s", parts[0], err)
 		}
-	}()
+	}
+	if parts[1] != "" {
+		if end, err = strconv.ParseInt(parts[1], 0, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid range end %q: %s", parts[1], err)
+		}
+	}
 	return
 }
 
-// return an evtx.Chunk object from a reader
-func fetchChunkFromReader(r io.ReadSeeker, offset int64) (evtx.Chunk, error) {
-	var err error
-	c := evtx.NewChunk()
-	evtx.GoToSeeker(r, offset)
-	c.Offset = offset
-	c.Data = make([]byte, evtx.ChunkSize)
-	if _, err = r.Read(c.Data); err != nil {
-		return c, err
-	}
-	reader := bytes.NewReader(c.Data)
-	c.ParseChunkHeader(reader)
-	if err = c.Header.Validate(); err != nil {
-		return c, err
-	}
-	// Go to after Header
-	evtx.GoToSeeker(reader, int64(c.Header.SizeHeader))
-	c.ParseStringTable(reader)
-	err = c.ParseTemplateTable(reader)
-	if err != nil {
-		return c, err
+// readResumeToken loads a previously saved resume token, returning nil if
+// path is empty or the file does not exist yet (first run).
+func readResumeToken(path string) []byte {
+	if path == "" {
+		return nil
 	}
-	err = c.ParseEventOffsets(reader)
+	tok, err := ioutil.ReadFile(path)
 	if err != nil {
-		return c, err
+		return nil
+	}
+	return tok
+}
+
+// writeResumeToken persists tok to path so a later invocation can continue
+// from there. Errors are logged but not fatal: worst case the next run
+// re-scans from the previous start.
+func writeResumeToken(path string, tok []byte) {
+	if path == "" {
+		return
+	}
+	if err := ioutil.WriteFile(path, tok, 0600); err != nil {
+		log.Errorf("Failed to write resume state to %s: %s", path, err)
 	}
-	return c, nil
 }
 
 // main routine to carve a file
-func carveFile(datafile string, offset int64, limit int) {
-	chunkCnt := 0
+func carveFile(datafile string, opts evtx.CarveOptions, resumeFile string) {
 	f, err := os.Open(datafile)
 	if err != nil {
 		log.LogErrorAndExit(err)
 	}
 	defer f.Close()
-	f.Seek(offset, os.SEEK_SET)
-	dup, err := os.Open(datafile)
+
+	opts.ResumeToken = readResumeToken(resumeFile)
+
+	carver, err := evtx.NewCarver(f, opts)
 	if err != nil {
 		log.LogErrorAndExit(err)
 	}
-	defer dup.Close()
-	dup.Seek(offset, os.SEEK_SET)
 
-	for offset := range findChunksOffsets(f) {
-		log.Infof("Parsing Chunk @ Offset: %d (0x%08[1]x)", offset)
-		chunk, err := fetchChunkFromReader(dup, offset)
-		if err != nil {
-			log.LogError(err)
+	// carver.ParallelEvents hands back CarvedEvent (event + chunk offset);
+	// processEvents only cares about the event itself, so unwrap it on a
+	// small adapter goroutine rather than teaching processEvents about
+	// carving.
+	events := make(chan *evtx.GoEvtxMap, 4096)
+	go func() {
+		defer close(events)
+		for ce := range carver.ParallelEvents(workers, !unordered) {
+			events <- ce.Event
 		}
-		for e := range chunk.Events() {
-			printEvent(e)
+	}()
+	processEvents(events, workers, !unordered)
+
+	writeResumeToken(resumeFile, carver.ResumeToken())
+}
+
+// renderEvent applies the -start/-stop time window and encodes e exactly as
+// printEvent used to do, but into its own buffer instead of writing straight
+// to encOut. Returning the rendered bytes (rather than writing them) is what
+// lets processEvents run this on a worker pool: the filtering and
+// marshalling it does is the actual per-event cost, and doing it
+// concurrently is the point of -workers for the non-carving path, where
+// chunk decoding itself (evtx.File.ParallelEvents) is not spread across
+// workers. A nil result means there is nothing for the caller to write:
+// the event was filtered out, a time lookup/encode error was already
+// logged, or the encoder (Parquet) wrote the event through its own writer.
+func renderEvent(e *evtx.GoEvtxMap) []byte {
+	if e == nil {
+		return nil
+	}
+
+	t, err := e.GetTime(&evtx.SystemTimePath)
+
+	// If not between start and stop we do not print
+	if time.Time(start) != defaultTime && time.Time(stop) != defaultTime {
+		if t.Before(time.Time(start)) || t.After(time.Time(stop)) {
+			return nil
 		}
-		chunkCnt++
+	}
 
-		if limit > 0 && chunkCnt >= limit {
-			break
+	// If before start we do not print
+	if time.Time(start) != defaultTime {
+		if t.Before(time.Time(start)) {
+			return nil
 		}
-		log.Debug("End of the loop")
 	}
+
+	// If after stop we do not print
+	if time.Time(stop) != defaultTime {
+		if t.After(time.Time(stop)) {
+			return nil
+		}
+	}
+
+	var buf bytes.Buffer
+
+	// The timestamp prefix only makes sense for the line-oriented text
+	// formats; binary formats carry TimeCreated in-band.
+	if timestamp && (format == "" || format == output.FormatNDJSON || format == output.FormatECS) {
+		if err != nil {
+			log.Errorf("Event time not found: %s", string(evtx.ToJSON(e)))
+			return nil
+		}
+		fmt.Fprintf(&buf, "%d: ", t.Unix())
+	}
+	if encErr := encoder.Encode(&buf, e); encErr != nil {
+		log.Errorf("Failed to encode event: %s", encErr)
+		return nil
+	}
+	return buf.Bytes()
 }
 
 // small routine that prints the EVTX event
 func printEvent(e *evtx.GoEvtxMap) {
-	if e != nil {
-		t, err := e.GetTime(&evtx.SystemTimePath)
+	data := renderEvent(e)
+	if data == nil {
+		return
+	}
+	if _, err := encOut.Write(data); err != nil {
+		log.Errorf("Failed to write event: %s", err)
+	}
+}
 
-		// If not between start and stop we do not print
-		if time.Time(start) != defaultTime && time.Time(stop) != defaultTime {
-			if t.Before(time.Time(start)) || t.After(time.Time(stop)) {
-				return
-			}
+// renderedItem pairs a worker's rendered output with the sequence number it
+// was submitted under, so ordered mode can write events back out in the
+// order they arrived on events.
+type renderedItem struct {
+	seq  int
+	data []byte
+}
+
+type renderedHeap []renderedItem
+
+func (h renderedHeap) Len() int            { return len(h) }
+func (h renderedHeap) Less(i, j int) bool  { return h[i].seq < h[j].seq }
+func (h renderedHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *renderedHeap) Push(x interface{}) { *h = append(*h, x.(renderedItem)) }
+func (h *renderedHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	*h = old[:n-1]
+	return it
+}
+
+// writeRendered writes data to encOut if non-nil, logging (but not failing
+// on) a write error the same way printEvent does.
+func writeRendered(data []byte) {
+	if data == nil {
+		return
+	}
+	if _, err := encOut.Write(data); err != nil {
+		log.Errorf("Failed to write event: %s", err)
+	}
+}
+
+// processEvents renders events across nWorkers goroutines (0 meaning
+// runtime.NumCPU()) instead of one at a time, so filtering and marshalling
+// a given event isn't a serial bottleneck behind decode. In ordered mode,
+// rendered output is written back out in the same order events arrived in,
+// via a small reorder buffer; in unordered mode it's written as soon as a
+// worker produces it.
+//
+// Parquet's encoder is stateful (it buffers rows into row groups) and is
+// not safe to call from multiple goroutines at once, so that format -
+// along with nWorkers == 1 - falls back to the original sequential path.
+func processEvents(events <-chan *evtx.GoEvtxMap, nWorkers int, ordered bool) {
+	if format == output.FormatParquet || nWorkers == 1 {
+		for e := range events {
+			printEvent(e)
 		}
+		return
+	}
+	if nWorkers <= 0 {
+		nWorkers = runtime.NumCPU()
+	}
 
-		// If before start we do not print
-		if time.Time(start) != defaultTime {
-			if t.Before(time.Time(start)) {
-				return
-			}
+	type eventJob struct {
+		seq int
+		e   *evtx.GoEvtxMap
+	}
+	jobs := make(chan eventJob, nWorkers)
+	go func() {
+		defer close(jobs)
+		seq := 0
+		for e := range events {
+			jobs <- eventJob{seq: seq, e: e}
+			seq++
 		}
+	}()
 
-		// If after stop we do not print
-		if time.Time(stop) != defaultTime {
-			if t.After(time.Time(stop)) {
-				return
+	results := make(chan renderedItem, nWorkers)
+	wdone := make(chan struct{}, nWorkers)
+	for w := 0; w < nWorkers; w++ {
+		go func() {
+			defer func() { wdone <- struct{}{} }()
+			for job := range jobs {
+				results <- renderedItem{seq: job.seq, data: renderEvent(job.e)}
 			}
+		}()
+	}
+	go func() {
+		for i := 0; i < nWorkers; i++ {
+			<-wdone
 		}
+		close(results)
+	}()
 
-		if timestamp {
-			if err == nil {
-				fmt.Printf("%d: %s\n", t.Unix(), string(evtx.ToJSON(e)))
-			} else {
-				log.Errorf("Event time not found: %s", string(evtx.ToJSON(e)))
-			}
-		} else {
-			fmt.Printf("%s\n", string(evtx.ToJSON(e)))
+	if !ordered {
+		for ri := range results {
+			writeRendered(ri.data)
 		}
+		return
+	}
 
+	pending := &renderedHeap{}
+	next := 0
+	for ri := range results {
+		heap.Push(pending, ri)
+		for pending.Len() > 0 && (*pending)[0].seq == next {
+			writeRendered(heap.Pop(pending).(renderedItem).data)
+			next++
+		}
+	}
+	for pending.Len() > 0 {
+		writeRendered(heap.Pop(pending).(renderedItem).data)
 	}
 }
 
@@ -188,6 +333,11 @@ func main() {
 	flag.BoolVar(&unordered, "u", unordered, "Does not care about ordering the events before printing (faster for large files)")
 	flag.Int64Var(&offset, "o", offset, "Offset to start from (carving mode only)")
 	flag.IntVar(&limit, "l", limit, "Limit the number of chunks to parse (carving mode only)")
+	flag.StringVar(&rng, "range", rng, "Byte range to carve, start:end (carving mode only, overrides -o)")
+	flag.StringVar(&resume, "resume", resume, "Resume/checkpoint file to pick up carving where a previous run left off")
+	flag.IntVar(&workers, "workers", workers, "Number of workers for chunk decoding (carving mode only) and event rendering (0 = runtime.NumCPU())")
+	flag.StringVar(&format, "format", format, "Output format: ndjson, ecs, cbor or parquet")
+	flag.StringVar(&outFile, "output", outFile, "File to write events to (defaults to stdout)")
 	flag.Var(&start, "start", "Print logs starting from start")
 	flag.Var(&stop, "stop", "Print logs before stop")
 
@@ -239,6 +389,23 @@ func main() {
 		}()
 	}
 
+	encOut = os.Stdout
+	if outFile != "" {
+		of, err := os.Create(outFile)
+		if err != nil {
+			log.LogErrorAndExit(err)
+		}
+		defer of.Close()
+		encOut = of
+	}
+
+	var err error
+	encoder, err = output.New(format, encOut)
+	if err != nil {
+		log.LogErrorAndExit(err)
+	}
+	defer encoder.Close()
+
 	for _, evtxFile := range flag.Args() {
 		if !carve {
 			// Regular EVTX file
@@ -247,13 +414,19 @@ func main() {
 				log.Error(err)
 				continue
 			}
-			for e := range ef.FastEvents() {
-				printEvent(e)
-			}
+			processEvents(ef.ParallelEvents(workers, !unordered), workers, !unordered)
 		} else {
 			evtx.SetModeCarving(true)
 			// We have to carve the file
-			carveFile(evtxFile, offset, limit)
+			rangeStart, rangeEnd, err := parseRange(rng)
+			if err != nil {
+				log.LogErrorAndExit(err)
+			}
+			if rng == "" {
+				rangeStart = offset
+			}
+			opts := evtx.CarveOptions{Start: rangeStart, End: rangeEnd, MaxChunks: limit}
+			carveFile(evtxFile, opts, resume)
 		}
 	}
 }